@@ -0,0 +1,159 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Auth sets whatever request-level authentication is needed, e.g. an
+// Authorization header, on an outgoing request.
+type Auth interface {
+	Authorize(request *http.Request)
+}
+
+// noAuth is used when http.auth isn't set, or for schemes (like cert://)
+// that authenticate at the TLS layer instead of via headers.
+type noAuth struct{}
+
+// Authorize implements Auth
+func (noAuth) Authorize(request *http.Request) {}
+
+// staticAuth sets the Authorization header to a literal, pre-built value,
+// for auth schemes not covered by basic/bearer.
+type staticAuth struct {
+	value string
+}
+
+// Authorize implements Auth
+func (a *staticAuth) Authorize(request *http.Request) {
+	request.Header.Set("Authorization", a.value)
+}
+
+// basicAuth sets HTTP Basic authentication.
+type basicAuth struct {
+	username string
+	password string
+}
+
+// Authorize implements Auth
+func (a *basicAuth) Authorize(request *http.Request) {
+	request.SetBasicAuth(a.username, a.password)
+}
+
+// bearerAuth sets an OAuth2-style bearer token.
+type bearerAuth struct {
+	token string
+}
+
+// Authorize implements Auth
+func (a *bearerAuth) Authorize(request *http.Request) {
+	request.Header.Set("Authorization", "Bearer "+a.token)
+}
+
+// configureTLS sets up the transport's TLS configuration - custom root CAs
+// (http.tls.ca), skipping verification (http.tls.insecure), and a client
+// certificate if http.auth=cert:// - then resolves the Auth implementation
+// named by http.auth.
+func configureTLS(route *router.Route, transport *http.Transport) (Auth, error) {
+	tlsConfig := &tls.Config{}
+
+	if caPath := getStringParameter(route.Options, "http.tls.ca", ""); caPath != "" {
+		caCert, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("http: unable to read http.tls.ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("http: unable to parse http.tls.ca: %s", caPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if getStringParameter(route.Options, "http.tls.insecure", "false") == "true" {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport.TLSClientConfig = tlsConfig
+
+	return newAuth(getStringParameter(route.Options, "http.auth", ""), transport)
+}
+
+// newAuth parses http.auth, a scheme-URL similar in shape to how routes
+// themselves are addressed: static://<header value>, basic://user:pass,
+// bearer://token, or cert://path/to/cert.pem?key=path/to/key.pem.
+func newAuth(authURL string, transport *http.Transport) (Auth, error) {
+	if authURL == "" {
+		return noAuth{}, nil
+	}
+
+	scheme, rest, ok := splitAuthScheme(authURL)
+	if !ok {
+		return nil, fmt.Errorf("http: invalid value for parameter: http.auth: %s", authURL)
+	}
+
+	switch scheme {
+	case "static":
+		return &staticAuth{value: rest}, nil
+	case "basic":
+		username, password, ok := splitUserPass(rest)
+		if !ok {
+			return nil, fmt.Errorf("http: basic:// auth requires user:pass")
+		}
+		return &basicAuth{username: username, password: password}, nil
+	case "bearer":
+		return &bearerAuth{token: rest}, nil
+	case "cert":
+		certPath, keyPath, err := splitCertKey(rest)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("http: unable to load client certificate: %v", err)
+		}
+		transport.TLSClientConfig.Certificates = append(transport.TLSClientConfig.Certificates, cert)
+		return noAuth{}, nil
+	default:
+		return nil, fmt.Errorf("http: unknown scheme for parameter: http.auth: %s", scheme)
+	}
+}
+
+func splitAuthScheme(s string) (scheme string, rest string, ok bool) {
+	idx := strings.Index(s, "://")
+	if idx < 0 {
+		return "", "", false
+	}
+	return s[:idx], s[idx+len("://"):], true
+}
+
+func splitUserPass(s string) (user string, pass string, ok bool) {
+	idx := strings.Index(s, ":")
+	if idx < 0 {
+		return "", "", false
+	}
+	return s[:idx], s[idx+1:], true
+}
+
+func splitCertKey(s string) (certPath string, keyPath string, err error) {
+	parts := strings.SplitN(s, "?", 2)
+	certPath = parts[0]
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("http: cert:// auth requires a ?key=path/to/key.pem query parameter")
+	}
+	values, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return "", "", fmt.Errorf("http: unable to parse cert:// query: %v", err)
+	}
+	keyPath = values.Get("key")
+	if keyPath == "" {
+		return "", "", fmt.Errorf("http: cert:// auth requires a ?key=path/to/key.pem query parameter")
+	}
+	return certPath, keyPath, nil
+}
@@ -0,0 +1,99 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Compressor compresses a request body, returning the compressed reader
+// and the Content-Encoding header value to send with it (empty for
+// identity/no compression).
+type Compressor interface {
+	Compress(body io.Reader) (io.Reader, string, error)
+}
+
+// newCompressor selects a Compressor based on the http.compression and
+// http.compression.level options. It falls back to the legacy http.gzip
+// true/false option when http.compression isn't set.
+func newCompressor(options map[string]string) (Compressor, error) {
+	algo := getStringParameter(options, "http.compression", "")
+	if algo == "" {
+		if getStringParameter(options, "http.gzip", "true") == "false" {
+			algo = "none"
+		} else {
+			algo = "gzip"
+		}
+	}
+
+	switch algo {
+	case "gzip":
+		level := getIntParameter(options, "http.compression.level", gzip.DefaultCompression)
+		if level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+			return nil, fmt.Errorf("http: invalid value for parameter: http.compression.level: %d", level)
+		}
+		return &gzipCompressor{level: level}, nil
+	case "zlib":
+		level := getIntParameter(options, "http.compression.level", zlib.DefaultCompression)
+		if level != zlib.DefaultCompression && (level < zlib.BestSpeed || level > zlib.BestCompression) {
+			return nil, fmt.Errorf("http: invalid value for parameter: http.compression.level: %d", level)
+		}
+		return &zlibCompressor{level: level}, nil
+	case "none":
+		return &identityCompressor{}, nil
+	default:
+		return nil, fmt.Errorf("http: unknown value for parameter: http.compression: %s", algo)
+	}
+}
+
+// gzipCompressor compresses with compress/gzip at a configurable level.
+type gzipCompressor struct {
+	level int
+}
+
+// Compress implements Compressor
+func (c *gzipCompressor) Compress(body io.Reader) (io.Reader, string, error) {
+	buf := new(bytes.Buffer)
+	writer, err := gzip.NewWriterLevel(buf, c.level)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := io.Copy(writer, body); err != nil {
+		return nil, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf, "gzip", nil
+}
+
+// zlibCompressor compresses with compress/zlib at a configurable level.
+type zlibCompressor struct {
+	level int
+}
+
+// Compress implements Compressor
+func (c *zlibCompressor) Compress(body io.Reader) (io.Reader, string, error) {
+	buf := new(bytes.Buffer)
+	writer, err := zlib.NewWriterLevel(buf, c.level)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := io.Copy(writer, body); err != nil {
+		return nil, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf, "deflate", nil
+}
+
+// identityCompressor passes the body through uncompressed.
+type identityCompressor struct{}
+
+// Compress implements Compressor
+func (c *identityCompressor) Compress(body io.Reader) (io.Reader, string, error) {
+	return body, "", nil
+}
@@ -0,0 +1,181 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// PayloadEncoder renders a batch of buffered messages as a request body,
+// along with the Content-Type that should be sent with it.
+type PayloadEncoder interface {
+	Encode(messages []*router.Message) (body io.Reader, contentType string)
+}
+
+// HeaderEncoder is implemented by encoders that need to set additional
+// request headers, e.g. an auth token tied to the payload format.
+type HeaderEncoder interface {
+	Headers() map[string]string
+}
+
+// newPayloadEncoder selects a PayloadEncoder based on the http.format
+// option. http.labels/http.env, if set, are forwarded to the encoder so it
+// can merge the matching container labels/env vars into each message.
+func newPayloadEncoder(options map[string]string) (PayloadEncoder, error) {
+	labelKeys := splitCSV(getStringParameter(options, "http.labels", ""))
+	envKeys := splitCSV(getStringParameter(options, "http.env", ""))
+
+	format := getStringParameter(options, "http.format", "sumo")
+	switch format {
+	case "sumo":
+		return &SumoEncoder{labelKeys: labelKeys, envKeys: envKeys}, nil
+	case "ndjson":
+		return &NDJSONEncoder{labelKeys: labelKeys, envKeys: envKeys}, nil
+	case "splunk_hec":
+		return &SplunkHECEncoder{
+			token:     getStringParameter(options, "http.splunk.token", ""),
+			labelKeys: labelKeys,
+			envKeys:   envKeys,
+		}, nil
+	default:
+		return nil, fmt.Errorf("http: unknown value for parameter: http.format: %s", format)
+	}
+}
+
+// decodeMessage parses a message's raw data as JSON, falling back to
+// wrapping it as {"msg": <raw data>} if it isn't valid JSON. It returns
+// the decoded object and whether the data was valid JSON.
+func decodeMessage(input *router.Message) (map[string]interface{}, bool) {
+	var message interface{}
+	validJSON := true
+	err := json.Unmarshal([]byte(input.Data), &message)
+	if err != nil {
+		validJSON = false
+		json.Unmarshal([]byte("{}"), &message)
+	}
+	messageIfc := message.(map[string]interface{})
+	if !validJSON {
+		messageIfc["msg"] = input.Data
+	}
+	return messageIfc, validJSON
+}
+
+// SumoEncoder is the legacy encoding used for the Sumo Logic HTTP source:
+// newline-delimited JSON objects with `time` hoisted to the first key, since
+// Sumo uses the first string in an object that looks like a timestamp.
+type SumoEncoder struct {
+	labelKeys []string
+	envKeys   []string
+}
+
+// Encode implements PayloadEncoder
+func (e *SumoEncoder) Encode(buffer []*router.Message) (io.Reader, string) {
+	messages := make([]string, 0, len(buffer))
+	for i := range buffer {
+		input := buffer[i]
+		messageIfc, _ := decodeMessage(input)
+		messageIfc["logspout"] = logspoutDataFor(input)
+		applyEnrichment(messageIfc, input, e.labelKeys, e.envKeys)
+
+		// save off the message timestamp, preferring the message's
+		// own `time` property if set
+		timestamp := input.Time.Format(TIME_FORMAT_RFC3339_MS)
+		if t, ok := messageIfc["time"]; ok {
+			if ts, ok := t.(string); ok {
+				timestamp = ts
+			}
+		}
+		delete(messageIfc, "time")
+
+		messageBuf, err := json.Marshal(messageIfc)
+		if err != nil {
+			debug("http: SumoEncoder - error encoding JSON:", err)
+			continue
+		}
+
+		// insert `time` at the head, since Go sorts keys and SumoLogic will
+		// use the first string that looks like a timestamp.
+		messageStr := "{\"time\":\"" + timestamp + "\"," + string(messageBuf[1:])
+		messages = append(messages, messageStr)
+	}
+	return strings.NewReader(strings.Join(messages, "\n")), "application/json"
+}
+
+// NDJSONEncoder encodes the batch as newline-delimited JSON, one object per
+// message. `time` is filled in from the message timestamp when absent, but
+// is not moved to the front of the object.
+type NDJSONEncoder struct {
+	labelKeys []string
+	envKeys   []string
+}
+
+// Encode implements PayloadEncoder
+func (e *NDJSONEncoder) Encode(buffer []*router.Message) (io.Reader, string) {
+	lines := make([]string, 0, len(buffer))
+	for i := range buffer {
+		input := buffer[i]
+		messageIfc, _ := decodeMessage(input)
+		messageIfc["logspout"] = logspoutDataFor(input)
+		applyEnrichment(messageIfc, input, e.labelKeys, e.envKeys)
+		if _, ok := messageIfc["time"]; !ok {
+			messageIfc["time"] = input.Time.Format(TIME_FORMAT_RFC3339_MS)
+		}
+
+		lineBuf, err := json.Marshal(messageIfc)
+		if err != nil {
+			debug("http: NDJSONEncoder - error encoding JSON:", err)
+			continue
+		}
+		lines = append(lines, string(lineBuf))
+	}
+	return strings.NewReader(strings.Join(lines, "\n")), "application/x-ndjson"
+}
+
+// SplunkHECEncoder encodes the batch for the Splunk HTTP Event Collector:
+// one {"event", "time", "host", "source"} object per message, with `time`
+// as Unix epoch seconds as HEC expects.
+type SplunkHECEncoder struct {
+	token     string
+	labelKeys []string
+	envKeys   []string
+}
+
+// Encode implements PayloadEncoder
+func (e *SplunkHECEncoder) Encode(buffer []*router.Message) (io.Reader, string) {
+	lines := make([]string, 0, len(buffer))
+	for i := range buffer {
+		input := buffer[i]
+		var event interface{}
+		if err := json.Unmarshal([]byte(input.Data), &event); err != nil {
+			event = input.Data
+		}
+		if eventMap, ok := event.(map[string]interface{}); ok {
+			applyEnrichment(eventMap, input, e.labelKeys, e.envKeys)
+		}
+		hecEvent := map[string]interface{}{
+			"event":  event,
+			"time":   float64(input.Time.UnixNano()) / float64(time.Second),
+			"host":   input.Container.Config.Hostname,
+			"source": input.Source,
+		}
+		lineBuf, err := json.Marshal(hecEvent)
+		if err != nil {
+			debug("http: SplunkHECEncoder - error encoding JSON:", err)
+			continue
+		}
+		lines = append(lines, string(lineBuf))
+	}
+	return strings.NewReader(strings.Join(lines, "\n")), "application/json"
+}
+
+// Headers implements HeaderEncoder, setting the HEC token auth header.
+func (e *SplunkHECEncoder) Headers() map[string]string {
+	if e.token == "" {
+		return nil
+	}
+	return map[string]string{"Authorization": "Splunk " + e.token}
+}
@@ -0,0 +1,13 @@
+package http
+
+import "testing"
+
+// An unrecognized http.format must fail adapter construction, not crash
+// the process the way die() does - same contract as newCompressor,
+// newFilters, and newWal.
+func TestNewPayloadEncoderUnknownFormat(t *testing.T) {
+	_, err := newPayloadEncoder(map[string]string{"http.format": "bogus"})
+	if err == nil {
+		t.Fatal("expected an error for an unrecognized http.format, got nil")
+	}
+}
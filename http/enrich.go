@@ -0,0 +1,82 @@
+package http
+
+import (
+	"strings"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// splitCSV splits a comma-separated option value into trimmed, non-empty
+// parts, e.g. "com.example.team, com.example.app".
+func splitCSV(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// containerEnrichment picks the requested container labels and environment
+// variables off a message's container, for merging into the outgoing
+// message under "labels"/"env".
+func containerEnrichment(input *router.Message, labelKeys, envKeys []string) (labels map[string]string, env map[string]string) {
+	if input.Container == nil || input.Container.Config == nil {
+		return nil, nil
+	}
+
+	if len(labelKeys) > 0 && input.Container.Config.Labels != nil {
+		for _, key := range labelKeys {
+			if value, ok := input.Container.Config.Labels[key]; ok {
+				if labels == nil {
+					labels = make(map[string]string, len(labelKeys))
+				}
+				labels[key] = value
+			}
+		}
+	}
+
+	if len(envKeys) > 0 {
+		for _, entry := range input.Container.Config.Env {
+			name, value, ok := splitEnvEntry(entry)
+			if !ok {
+				continue
+			}
+			for _, key := range envKeys {
+				if name == key {
+					if env == nil {
+						env = make(map[string]string, len(envKeys))
+					}
+					env[key] = value
+				}
+			}
+		}
+	}
+
+	return labels, env
+}
+
+func splitEnvEntry(entry string) (name string, value string, ok bool) {
+	idx := strings.Index(entry, "=")
+	if idx < 0 {
+		return "", "", false
+	}
+	return entry[:idx], entry[idx+1:], true
+}
+
+// applyEnrichment merges the requested labels/env into a decoded message
+// object, under "labels"/"env" keys, alongside "logspout".
+func applyEnrichment(messageIfc map[string]interface{}, input *router.Message, labelKeys, envKeys []string) {
+	labels, env := containerEnrichment(input, labelKeys, envKeys)
+	if len(labels) > 0 {
+		messageIfc["labels"] = labels
+	}
+	if len(env) > 0 {
+		messageIfc["env"] = env
+	}
+}
@@ -0,0 +1,20 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// containerEnrichment must tolerate a message with no container, the same
+// way filter.go's label/image filters do - Container can be nil depending
+// on how the message reached the adapter.
+func TestContainerEnrichmentNilContainer(t *testing.T) {
+	message := &router.Message{Data: "{}"}
+
+	labels, env := containerEnrichment(message, []string{"com.example.team"}, []string{"ENV"})
+
+	if labels != nil || env != nil {
+		t.Fatalf("expected nil labels/env for a message with no container, got %v / %v", labels, env)
+	}
+}
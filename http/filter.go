@@ -0,0 +1,130 @@
+package http
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Filter decides whether a message should be kept (true) or suppressed
+// (false) before it's ever buffered.
+type Filter interface {
+	Allow(input *router.Message) bool
+}
+
+// labelFilter keeps (or, negated, drops) messages whose container carries
+// a label matching a glob, e.g. http.filter.label=com.example.logs=true.
+type labelFilter struct {
+	key     string
+	pattern *regexp.Regexp
+	negate  bool
+}
+
+// Allow implements Filter
+func (f *labelFilter) Allow(input *router.Message) bool {
+	value := ""
+	if input.Container != nil && input.Container.Config != nil {
+		value = input.Container.Config.Labels[f.key]
+	}
+	matched := f.pattern.MatchString(value)
+	if f.negate {
+		return !matched
+	}
+	return matched
+}
+
+// imageFilter keeps (or, negated, drops) messages whose container image
+// matches a glob, e.g. http.filter.image=!nginx:*.
+type imageFilter struct {
+	pattern *regexp.Regexp
+	negate  bool
+}
+
+// Allow implements Filter
+func (f *imageFilter) Allow(input *router.Message) bool {
+	image := ""
+	if input.Container != nil && input.Container.Config != nil {
+		image = input.Container.Config.Image
+	}
+	matched := f.pattern.MatchString(image)
+	if f.negate {
+		return !matched
+	}
+	return matched
+}
+
+// newFilters compiles the http.filter.label/http.filter.image options into
+// Filters, evaluated once per message in Stream before it's buffered.
+func newFilters(options map[string]string) ([]Filter, error) {
+	var filters []Filter
+
+	if raw := getStringParameter(options, "http.filter.label", ""); raw != "" {
+		negate, raw := splitFilterNegation(raw)
+		key, globPattern, ok := splitLabelFilter(raw)
+		if !ok {
+			return nil, fmt.Errorf("http: invalid value for parameter: http.filter.label: %s", raw)
+		}
+		pattern, err := compileGlob(globPattern)
+		if err != nil {
+			return nil, fmt.Errorf("http: invalid glob in http.filter.label: %v", err)
+		}
+		filters = append(filters, &labelFilter{key: key, pattern: pattern, negate: negate})
+	}
+
+	if raw := getStringParameter(options, "http.filter.image", ""); raw != "" {
+		negate, raw := splitFilterNegation(raw)
+		pattern, err := compileGlob(raw)
+		if err != nil {
+			return nil, fmt.Errorf("http: invalid glob in http.filter.image: %v", err)
+		}
+		filters = append(filters, &imageFilter{pattern: pattern, negate: negate})
+	}
+
+	return filters, nil
+}
+
+// matchesFilters reports whether a message passes every configured filter.
+func matchesFilters(filters []Filter, input *router.Message) bool {
+	for _, filter := range filters {
+		if !filter.Allow(input) {
+			return false
+		}
+	}
+	return true
+}
+
+func splitFilterNegation(raw string) (negate bool, rest string) {
+	if strings.HasPrefix(raw, "!") {
+		return true, raw[1:]
+	}
+	return false, raw
+}
+
+func splitLabelFilter(raw string) (key string, globPattern string, ok bool) {
+	idx := strings.Index(raw, "=")
+	if idx < 0 {
+		return "", "", false
+	}
+	return raw[:idx], raw[idx+1:], true
+}
+
+// compileGlob turns a simple shell glob (* and ?) into a regexp anchored
+// to the whole string.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -2,9 +2,6 @@ package http
 
 import (
 	"bytes"
-	"compress/gzip"
-	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,7 +11,6 @@ import (
 	"net/url"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -29,6 +25,8 @@ var dialTimeout time.Duration
 func init() {
 	dialTimeout, _ = time.ParseDuration("30s")
 	router.AdapterFactories.Register(NewHTTPAdapter, "sumo")
+	router.AdapterFactories.Register(NewHTTPAdapter, "http")
+	router.AdapterFactories.Register(NewHTTPAdapter, "https")
 }
 
 func debug(v ...interface{}) {
@@ -105,14 +103,34 @@ type HTTPAdapter struct {
 	timeout           time.Duration
 	totalMessageCount int
 	bufferMutex       sync.Mutex
-	useGzip           bool
-	crash             bool
+	compressor        Compressor
+	auth              Auth
+	onFailure         string
+	retryMax          int
+	retryInitial      time.Duration
+	retryMaxBackoff   time.Duration
 	headers           map[string]string
+	encoder           PayloadEncoder
+	wal               *Wal
+	bufferSeqs        []int64
+	inflight          chan struct{}
+	filters           []Filter
+	ackMutex          sync.Mutex
+	pendingAcks       []int64
+	ackedSeqs         map[int64]bool
 }
 
-// NewHTTPAdapter creates an HTTPAdapter
+// NewHTTPAdapter creates an HTTPAdapter. It backs three routes: "sumo",
+// which keeps the legacy hardcoded Sumo Logic collector endpoint, and
+// "http"/"https", which POST to the destination given in route.Address.
 func NewHTTPAdapter(route *router.Route) (router.LogAdapter, error) {
-	endpointUrl := fmt.Sprintf("https://collectors.sumologic.com/receiver/v1/http/%s", route.Address)
+	var endpointUrl string
+	switch route.Adapter {
+	case "http", "https":
+		endpointUrl = route.Adapter + "://" + route.Address
+	default:
+		endpointUrl = fmt.Sprintf("https://collectors.sumologic.com/receiver/v1/http/%s", route.Address)
+	}
 	debug("http: url:", endpointUrl)
 	transport := &http.Transport{}
 	transport.Dial = dial
@@ -126,12 +144,42 @@ func NewHTTPAdapter(route *router.Route) (router.LogAdapter, error) {
 			die("", "http: cannot parse proxy url:", err, proxyUrlString)
 		}
 		transport.Proxy = http.ProxyURL(proxyUrl)
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 		debug("http: proxy url:", proxyUrl)
 	}
 
+	// Configure TLS (custom CA, insecure skip-verify, client cert) and
+	// resolve the auth scheme named by http.auth
+	auth, err := configureTLS(route, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connection tuning: a stuck TLS handshake or slow response body
+	// shouldn't hang a flush goroutine forever, and idle connections
+	// shouldn't pile up unbounded
+	transport.TLSHandshakeTimeout = getDurationParameter(
+		route.Options, "http.timeout.tls_handshake", 10*time.Second)
+	transport.ResponseHeaderTimeout = getDurationParameter(
+		route.Options, "http.timeout.response_header", 0)
+	transport.IdleConnTimeout = getDurationParameter(
+		route.Options, "http.idle_conn_timeout", 90*time.Second)
+	transport.MaxIdleConns = getIntParameter(route.Options, "http.max_idle_conns", 100)
+	transport.MaxConnsPerHost = getIntParameter(route.Options, "http.max_conns_per_host", 0)
+
+	requestTimeout := getDurationParameter(route.Options, "http.timeout.request", 30*time.Second)
+
 	// Create the client
-	client := &http.Client{Transport: transport}
+	client := &http.Client{Transport: transport, Timeout: requestTimeout}
+
+	// Cap the number of flushes in flight at once, so a stalled upstream
+	// applies backpressure instead of spawning unbounded goroutines
+	maxInflight := getIntParameter(route.Options, "http.max_inflight", 4)
+	if maxInflight < 1 {
+		debug("http: non-sensical value for parameter: http.max_inflight",
+			maxInflight, "using default:", 4)
+		maxInflight = 4
+	}
+	inflight := make(chan struct{}, maxInflight)
 
 	// Determine the buffer capacity
 	defaultCapacity := 100
@@ -156,22 +204,39 @@ func NewHTTPAdapter(route *router.Route) (router.LogAdapter, error) {
 	}
 	timer := time.NewTimer(timeout)
 
-	// Figure out whether we should use GZIP compression
-	useGzip := false
-	useGZipString := getStringParameter(route.Options, "http.gzip", "true")
-	if useGZipString == "true" {
-		useGzip = true
-		debug("http: gzip compression enabled")
+	// Figure out which compression, if any, to use
+	compressor, err := newCompressor(route.Options)
+	if err != nil {
+		return nil, err
 	}
 
-	// Should we crash on an error or keep going?
-	crash := true
-	crashString := getStringParameter(route.Options, "http.crash", "true")
-	if crashString == "false" {
-		crash = false
-		debug("http: don't crash, keep going")
+	// What should happen to a batch that can't be delivered after retries?
+	// http.crash is kept as a deprecated alias for http.on_failure=drop.
+	defaultOnFailure := onFailureCrash
+	if getStringParameter(route.Options, "http.crash", "true") == "false" {
+		defaultOnFailure = onFailureDrop
+	}
+	onFailure := getStringParameter(route.Options, "http.on_failure", defaultOnFailure)
+	switch onFailure {
+	case onFailureCrash, onFailureDrop, onFailureDeadLetter:
+	default:
+		debug("http: non-sensical value for parameter: http.on_failure",
+			onFailure, "using default:", onFailureCrash)
+		onFailure = onFailureCrash
 	}
 
+	// Retry configuration: full-jitter exponential backoff
+	retryMax := getIntParameter(route.Options, "http.retry.max", 5)
+	if retryMax < 0 {
+		debug("http: non-sensical value for parameter: http.retry.max",
+			retryMax, "using default:", 5)
+		retryMax = 5
+	}
+	retryInitial := getDurationParameter(
+		route.Options, "http.retry.initial", 500*time.Millisecond)
+	retryMaxBackoff := getDurationParameter(
+		route.Options, "http.retry.max_backoff", 30*time.Second)
+
 	headers := make(map[string]string)
 	if host := getStringParameter(route.Options, "host", ""); host != "" {
 		headers["X-Sumo-Host"] = host
@@ -180,30 +245,93 @@ func NewHTTPAdapter(route *router.Route) (router.LogAdapter, error) {
 		headers["X-Sumo-Name"] = name
 	}
 
+	// Pick the payload encoder based on http.format
+	encoder, err := newPayloadEncoder(route.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compile the container label/image filters, if any
+	filters, err := newFilters(route.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set up the write-ahead log, if http.wal.dir is configured
+	var wal *Wal
+	if walDir := getStringParameter(route.Options, "http.wal.dir", ""); walDir != "" {
+		segmentSize := int64(getIntParameter(
+			route.Options, "http.wal.segment_size", 16*1024*1024))
+		maxBytes := int64(getIntParameter(route.Options, "http.wal.max_bytes", 0))
+		walOverflow := getStringParameter(route.Options, "http.wal.overflow", overflowBlock)
+		switch walOverflow {
+		case overflowBlock, overflowDropOldest:
+		default:
+			debug("http: non-sensical value for parameter: http.wal.overflow",
+				walOverflow, "using default:", overflowBlock)
+			walOverflow = overflowBlock
+		}
+		wal, err = newWal(walDir, segmentSize, maxBytes, walOverflow)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Make the HTTP adapter
 	return &HTTPAdapter{
-		route:    route,
-		url:      endpointUrl,
-		client:   client,
-		buffer:   buffer,
-		timer:    timer,
-		capacity: capacity,
-		timeout:  timeout,
-		useGzip:  useGzip,
-		crash:    crash,
-		headers:  headers,
+		route:           route,
+		url:             endpointUrl,
+		client:          client,
+		buffer:          buffer,
+		timer:           timer,
+		capacity:        capacity,
+		timeout:         timeout,
+		compressor:      compressor,
+		auth:            auth,
+		onFailure:       onFailure,
+		retryMax:        retryMax,
+		retryInitial:    retryInitial,
+		retryMaxBackoff: retryMaxBackoff,
+		headers:         headers,
+		encoder:         encoder,
+		wal:             wal,
+		inflight:        inflight,
+		filters:         filters,
 	}, nil
 }
 
 // Stream implements the router.LogAdapter interface
 func (a *HTTPAdapter) Stream(logstream chan *router.Message) {
+
+	// Replay the records still in the WAL from a previous run before
+	// processing new messages
+	if a.wal != nil {
+		a.replayWAL()
+	}
+
 	for {
 		select {
 		case message := <-logstream:
 
+			// Drop messages suppressed by http.filter.label/http.filter.image
+			// before they're ever durably recorded or buffered
+			if !matchesFilters(a.filters, message) {
+				continue
+			}
+
+			// Durably record the message before buffering it, if a WAL is
+			// configured
+			var seq int64
+			if a.wal != nil {
+				seq = a.wal.Append(walRecordFor(message))
+			}
+
 			// Append the message to the buffer
 			a.bufferMutex.Lock()
 			a.buffer = append(a.buffer, message)
+			if a.wal != nil {
+				a.bufferSeqs = append(a.bufferSeqs, seq)
+			}
 			a.bufferMutex.Unlock()
 
 			// Flush if the buffer is at capacity
@@ -218,6 +346,34 @@ func (a *HTTPAdapter) Stream(logstream chan *router.Message) {
 	}
 }
 
+// replayWAL pushes every record still in the WAL through the normal send path
+// before the adapter starts taking new messages from logstream.
+func (a *HTTPAdapter) replayWAL() {
+	records, err := a.wal.ReadAll()
+	if err != nil {
+		debug("http: error reading WAL for replay:", err)
+		return
+	}
+	if len(records) == 0 {
+		return
+	}
+	debug("http: replaying", len(records), "un-acked WAL record(s)")
+
+	for i := 0; i < len(records); i += a.capacity {
+		end := i + a.capacity
+		if end > len(records) {
+			end = len(records)
+		}
+		chunk := records[i:end]
+		batch := make([]*router.Message, len(chunk))
+		for j, rec := range chunk {
+			batch[j] = rec.toMessage()
+		}
+		a.sendBatch(batch)
+		a.wal.Ack(chunk[len(chunk)-1].Seq)
+	}
+}
+
 // Flushes the accumulated messages in the buffer
 func (a *HTTPAdapter) flushHttp(reason string) {
 
@@ -236,139 +392,141 @@ func (a *HTTPAdapter) flushHttp(reason string) {
 		return
 	}
 
-	// Capture the buffer and make a new one
+	// Capture the buffer and make new ones
 	a.bufferMutex.Lock()
 	buffer := a.buffer
 	a.buffer = make([]*router.Message, 0, a.capacity)
+	seqs := a.bufferSeqs
+	a.bufferSeqs = nil
 	a.bufferMutex.Unlock()
 
-	// Create JSON representation of all messages
-	messages := make([]string, 0, len(buffer))
-	for i := range buffer {
-		input := buffer[i]
-		var message interface{}
-
-		// attempt to JSON decode the message
-		validJSON := true
-		err := json.Unmarshal([]byte(input.Data), &message)
-		if err != nil {
-			validJSON = false
-			json.Unmarshal([]byte("{}"), &message)
-		}
+	// Record this batch's high-water seq as pending before it can complete
+	// out of order, so completeAck only ever advances the WAL past a
+	// contiguous run of finished batches
+	var batchSeq int64
+	hasSeq := a.wal != nil && len(seqs) > 0
+	if hasSeq {
+		batchSeq = seqs[len(seqs)-1]
+		a.ackMutex.Lock()
+		a.pendingAcks = append(a.pendingAcks, batchSeq)
+		a.ackMutex.Unlock()
+	}
 
-		messageIfc := message.(map[string]interface{})
+	// Wait for an in-flight slot before spawning the send, so a stalled
+	// upstream blocks here - applying backpressure to Stream - instead of
+	// piling up goroutines
+	a.inflight <- struct{}{}
 
-		// include the raw message if it wasn't valid JSON
-		if !validJSON {
-			messageIfc["msg"] = input.Data
+	go func() {
+		defer func() { <-a.inflight }()
+
+		debug("http: flushing:", reason, "messages:", len(buffer))
+		a.sendBatch(buffer)
+
+		// Once the batch's fate is decided - delivered, or permanently
+		// disposed of per http.on_failure - mark it done. Flushes can
+		// finish out of submission order (up to http.max_inflight run
+		// concurrently), so the WAL is only advanced past the longest
+		// contiguous prefix of done batches, never past one still in
+		// flight.
+		if hasSeq {
+			a.completeAck(batchSeq)
 		}
+	}()
+}
 
-		// include the logspout data
-		messageIfc["logspout"] = LogspoutData{
-			Time:     input.Time.Format(TIME_FORMAT_RFC3339_MS),
-			Source:   input.Source,
-			Name:     input.Container.Name,
-			ID:       input.Container.ID,
-			Image:    input.Container.Config.Image,
-			Hostname: input.Container.Config.Hostname,
-		}
+// completeAck marks the flush ending in seq as done and advances the WAL
+// past the longest contiguous prefix of done batches, so a still-in-flight
+// earlier batch can never have its WAL segment deleted out from under it.
+func (a *HTTPAdapter) completeAck(seq int64) {
+	a.ackMutex.Lock()
+	defer a.ackMutex.Unlock()
 
-		// save off the message timestamp, preferring the message's
-		// own `time` property if set
-		timestamp := input.Time.Format(TIME_FORMAT_RFC3339_MS)
-		if t, ok := messageIfc["time"]; ok {
-			timestamp = t.(string)
-		}
-		delete(messageIfc, "time")
+	if a.ackedSeqs == nil {
+		a.ackedSeqs = make(map[int64]bool)
+	}
+	a.ackedSeqs[seq] = true
+
+	watermark := int64(-1)
+	advanced := false
+	for len(a.pendingAcks) > 0 && a.ackedSeqs[a.pendingAcks[0]] {
+		watermark = a.pendingAcks[0]
+		advanced = true
+		delete(a.ackedSeqs, a.pendingAcks[0])
+		a.pendingAcks = a.pendingAcks[1:]
+	}
+	if advanced {
+		a.wal.Ack(watermark)
+	}
+}
 
-		messageBuf, err := json.Marshal(message)
-		if err != nil {
-			debug("flushHttp - Error encoding JSON: ", err)
-			continue
-		}
+// sendBatch encodes, compresses and sends one batch of messages, retrying
+// on network errors and 429/5xx responses. On permanent failure it hands
+// the batch to onSendFailure per the configured http.on_failure mode.
+func (a *HTTPAdapter) sendBatch(buffer []*router.Message) {
 
-		// insert `time` at the head, since Go sorts keys and SumoLogic will use
-		// the first string that looks like a timestamp.
-		messageStr := "{\"time\":\"" + timestamp + "\"," + string(messageBuf[1:])
+	// Encode the batch into a request body
+	body, contentType := a.encoder.Encode(buffer)
 
-		messages = append(messages, messageStr)
+	// Encoders may need to set additional headers, e.g. an auth token
+	headers := a.headers
+	if he, ok := a.encoder.(HeaderEncoder); ok {
+		headers = mergeHeaders(a.headers, he.Headers())
 	}
 
-	// Glue all the JSON representations together into one payload to send
-	payload := strings.Join(messages, "\n")
+	// Materialize the encoded body once: it's consumed by the compressor
+	// below, but onSendFailure also needs it (uncompressed) for dead-lettering
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		debug("http: error reading encoded payload:", err)
+		a.onSendFailure(buffer, nil, err)
+		return
+	}
 
-	go func() {
+	// Compress the payload
+	compressedBody, encoding, err := a.compressor.Compress(bytes.NewReader(raw))
+	if err != nil {
+		debug("http: error compressing payload:", err)
+		a.onSendFailure(buffer, raw, err)
+		return
+	}
+	payload, err := ioutil.ReadAll(compressedBody)
+	if err != nil {
+		debug("http: error reading compressed payload:", err)
+		a.onSendFailure(buffer, raw, err)
+		return
+	}
 
-		// Create the request and send it on its way
-		request := createRequest(a.url, a.useGzip, payload, a.headers)
-		start := time.Now()
-		response, err := a.client.Do(request)
-		if err != nil {
-			debug("http - error on client.Do:", err, a.url)
-			// TODO @raychaser - now what?
-			if a.crash {
-				die("http - error on client.Do:", err, a.url)
-			} else {
-				debug("http: error on client.Do:", err)
-			}
-		}
-		if response.StatusCode != 200 {
-			debug("http: response not 200 but", response.StatusCode)
-			// TODO @raychaser - now what?
-			if a.crash {
-				die("http: response not 200 but", response.StatusCode)
-			}
-		}
+	start := time.Now()
+	response, err := a.sendWithRetry(payload, contentType, encoding, headers)
+	if err != nil {
+		debug("http: giving up on batch:", err)
+		a.onSendFailure(buffer, raw, err)
+		return
+	}
 
-		// Make sure the entire response body is read so the HTTP
-		// connection can be reused
-		io.Copy(ioutil.Discard, response.Body)
-		response.Body.Close()
+	// Make sure the entire response body is read so the HTTP
+	// connection can be reused
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
 
-		// Bookkeeping, logging
-		timeAll := time.Since(start)
-		a.totalMessageCount += len(messages)
-		debug("http: flushed:", reason, "messages:", len(messages),
-			"in:", timeAll, "total:", a.totalMessageCount)
-	}()
+	// Bookkeeping, logging
+	timeAll := time.Since(start)
+	a.totalMessageCount += len(buffer)
+	debug("http: flushed: messages:", len(buffer),
+		"in:", timeAll, "total:", a.totalMessageCount)
 }
 
-// Create the request based on whether GZIP compression is to be used
-func createRequest(url string, useGzip bool, payload string, headers map[string]string) *http.Request {
-	var request *http.Request
-	if useGzip {
-		gzipBuffer := new(bytes.Buffer)
-		gzipWriter := gzip.NewWriter(gzipBuffer)
-		_, err := gzipWriter.Write([]byte(payload))
-		if err != nil {
-			// TODO @raychaser - now what?
-			die("http: unable to write to GZIP writer:", err)
-		}
-		err = gzipWriter.Close()
-		if err != nil {
-			// TODO @raychaser - now what?
-			die("http: unable to close GZIP writer:", err)
-		}
-		request, err = http.NewRequest("POST", url, gzipBuffer)
-		if err != nil {
-			debug("http: error on http.NewRequest:", err, url)
-			// TODO @raychaser - now what?
-			die("", "http: error on http.NewRequest:", err, url)
-		}
-		request.Header.Set("Content-Encoding", "gzip")
-	} else {
-		var err error
-		request, err = http.NewRequest("POST", url, strings.NewReader(payload))
-		if err != nil {
-			debug("http: error on http.NewRequest:", err, url)
-			// TODO @raychaser - now what?
-			die("", "http: error on http.NewRequest:", err, url)
-		}
+// mergeHeaders returns a new map containing base overlaid with extra.
+func mergeHeaders(base map[string]string, extra map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(extra))
+	for k, v := range base {
+		merged[k] = v
 	}
-	for k, v := range headers {
-		request.Header.Set(k, v)
+	for k, v := range extra {
+		merged[k] = v
 	}
-	return request
+	return merged
 }
 
 // LogspoutData is a simple JSON representation of the logspout message data.
@@ -380,3 +538,15 @@ type LogspoutData struct {
 	Image    string `json:"docker_image"`
 	Hostname string `json:"docker_hostname"`
 }
+
+// logspoutDataFor builds the LogspoutData metadata for a single message.
+func logspoutDataFor(input *router.Message) LogspoutData {
+	return LogspoutData{
+		Time:     input.Time.Format(TIME_FORMAT_RFC3339_MS),
+		Source:   input.Source,
+		Name:     input.Container.Name,
+		ID:       input.Container.ID,
+		Image:    input.Container.Config.Image,
+		Hostname: input.Container.Config.Hostname,
+	}
+}
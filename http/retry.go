@@ -0,0 +1,213 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	onFailureCrash      = "crash"
+	onFailureDrop       = "drop"
+	onFailureDeadLetter = "dead_letter"
+
+	defaultDeadLetterCapacity = 1000
+)
+
+// httpStatusError represents a non-2xx HTTP response from the destination.
+type httpStatusError struct {
+	statusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("http: response not OK: %d", e.statusCode)
+}
+
+// computeBackoff implements full jitter: a random duration between 0 and
+// min(maxBackoff, initial*2^attempt).
+func computeBackoff(attempt int, initial, maxBackoff time.Duration) time.Duration {
+	if attempt > 30 {
+		// avoid overflowing the shift below for pathological configs
+		attempt = 30
+	}
+	backoffCap := initial * time.Duration(int64(1)<<uint(attempt))
+	if backoffCap <= 0 || backoffCap > maxBackoff {
+		backoffCap = maxBackoff
+	}
+	if backoffCap <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoffCap)))
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// DeadLetterEntry records a batch that was permanently dropped after
+// exhausting retries (or hit a permanent 4xx), for `http.on_failure=dead_letter`.
+type DeadLetterEntry struct {
+	Time     time.Time `json:"time"`
+	URL      string    `json:"url"`
+	Error    string    `json:"error"`
+	Messages int       `json:"messages"`
+	// Payload is the encoded (pre-compression) request body, so it's
+	// readable JSON/text regardless of http.compression.
+	Payload string `json:"payload,omitempty"`
+}
+
+// deadLetterBuffer is a fixed-capacity ring buffer of DeadLetterEntry.
+type deadLetterBuffer struct {
+	mu    sync.Mutex
+	items []DeadLetterEntry
+	next  int
+	count int
+}
+
+func newDeadLetterBuffer(capacity int) *deadLetterBuffer {
+	return &deadLetterBuffer{items: make([]DeadLetterEntry, capacity)}
+}
+
+// Add records an entry, overwriting the oldest one once the buffer is full.
+func (b *deadLetterBuffer) Add(entry DeadLetterEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.items[b.next] = entry
+	b.next = (b.next + 1) % len(b.items)
+	if b.count < len(b.items) {
+		b.count++
+	}
+}
+
+// Snapshot returns the buffered entries, oldest first.
+func (b *deadLetterBuffer) Snapshot() []DeadLetterEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]DeadLetterEntry, 0, b.count)
+	if b.count < len(b.items) {
+		return append(out, b.items[:b.count]...)
+	}
+	out = append(out, b.items[b.next:]...)
+	out = append(out, b.items[:b.next]...)
+	return out
+}
+
+// deadLetters is the process-wide dead letter buffer, shared by every
+// HTTPAdapter instance and exposed via the debug endpoint below.
+var deadLetters = newDeadLetterBuffer(defaultDeadLetterCapacity)
+
+func init() {
+	http.HandleFunc("/debug/http-adapter/dead-letters", deadLettersHandler)
+}
+
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deadLetters.Snapshot())
+}
+
+// sendWithRetry POSTs payload to a.url, retrying network errors and
+// 429/5xx responses with full-jitter exponential backoff (honoring
+// Retry-After when present). 4xx responses other than 429 are permanent
+// and returned immediately without retrying.
+func (a *HTTPAdapter) sendWithRetry(payload []byte, contentType, encoding string, headers map[string]string) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequest("POST", a.url, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if encoding != "" {
+			request.Header.Set("Content-Encoding", encoding)
+		}
+		if contentType != "" {
+			request.Header.Set("Content-Type", contentType)
+		}
+		for k, v := range headers {
+			request.Header.Set(k, v)
+		}
+		a.auth.Authorize(request)
+
+		response, err := a.client.Do(request)
+		if err == nil && response.StatusCode < 300 {
+			return response, nil
+		}
+
+		var retryable bool
+		var retryAfter time.Duration
+		if err != nil {
+			lastErr = err
+			retryable = true
+			debug("http: network error on attempt", attempt, ":", err)
+		} else {
+			lastErr = &httpStatusError{statusCode: response.StatusCode}
+			retryable = response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+			retryAfter, _ = parseRetryAfter(response.Header.Get("Retry-After"))
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+			if !retryable {
+				debug("http: permanent failure, not retrying:", response.StatusCode)
+				return nil, lastErr
+			}
+			debug("http: retryable response on attempt", attempt, ":", response.StatusCode)
+		}
+
+		if attempt >= a.retryMax {
+			return nil, lastErr
+		}
+
+		sleep := computeBackoff(attempt, a.retryInitial, a.retryMaxBackoff)
+		if retryAfter > sleep {
+			sleep = retryAfter
+		}
+		debug("http: retrying in", sleep, "- attempt", attempt+1, "of", a.retryMax)
+		time.Sleep(sleep)
+	}
+}
+
+// onSendFailure handles a batch that could not be delivered after retries
+// (or hit a permanent 4xx), per the configured http.on_failure mode. payload
+// is the encoded, pre-compression request body, so dead-lettered entries
+// stay human-readable regardless of http.compression.
+func (a *HTTPAdapter) onSendFailure(batch []*router.Message, payload []byte, err error) {
+	switch a.onFailure {
+	case onFailureDrop:
+		debug("http: dropping batch after failure:", err, "messages:", len(batch))
+	case onFailureDeadLetter:
+		debug("http: dead-lettering batch after failure:", err, "messages:", len(batch))
+		deadLetters.Add(DeadLetterEntry{
+			Time:     time.Now(),
+			URL:      a.url,
+			Error:    err.Error(),
+			Messages: len(batch),
+			Payload:  string(payload),
+		})
+	default:
+		die("http: giving up after retries:", err)
+	}
+}
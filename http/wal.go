@@ -0,0 +1,315 @@
+package http
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+const (
+	overflowBlock      = "block"
+	overflowDropOldest = "drop_oldest"
+)
+
+// walRecord is the on-disk, length-prefixed-JSON representation of a
+// message accepted for delivery, denormalized so it can be replayed into
+// a *router.Message without a live container to ask.
+type walRecord struct {
+	Seq               int64     `json:"seq"`
+	Time              time.Time `json:"time"`
+	Source            string    `json:"source"`
+	Data              string    `json:"data"`
+	ContainerID       string    `json:"container_id"`
+	ContainerName     string    `json:"container_name"`
+	ContainerImage    string    `json:"container_image"`
+	ContainerHostname string    `json:"container_hostname"`
+}
+
+func walRecordFor(message *router.Message) walRecord {
+	return walRecord{
+		Time:              message.Time,
+		Source:            message.Source,
+		Data:              message.Data,
+		ContainerID:       message.Container.ID,
+		ContainerName:     message.Container.Name,
+		ContainerImage:    message.Container.Config.Image,
+		ContainerHostname: message.Container.Config.Hostname,
+	}
+}
+
+func (r walRecord) toMessage() *router.Message {
+	return &router.Message{
+		Data:   r.Data,
+		Time:   r.Time,
+		Source: r.Source,
+		Container: &docker.Container{
+			ID:   r.ContainerID,
+			Name: r.ContainerName,
+			Config: &docker.Config{
+				Image:    r.ContainerImage,
+				Hostname: r.ContainerHostname,
+			},
+		},
+	}
+}
+
+// walSegment is one rotated file of the WAL.
+type walSegment struct {
+	id         int
+	path       string
+	file       *os.File
+	size       int64
+	hasRecords bool
+	firstSeq   int64
+	lastSeq    int64
+}
+
+// Wal is a segmented, length-prefixed write-ahead log: every message
+// accepted by the adapter is appended here before being handed to the
+// in-memory flush buffer, so it survives a crash or restart. Once a batch
+// is durably delivered (or otherwise disposed of, per http.on_failure),
+// Ack deletes the rotated-away segments it fully covers. No committed
+// offset is stored, so records left in a segment that is still on disk
+// (always including the active one) are replayed on restart even if they
+// were already acked.
+type Wal struct {
+	mu          sync.Mutex
+	spaceCond   *sync.Cond
+	dir         string
+	segmentSize int64
+	maxBytes    int64
+	overflow    string
+
+	segments   []*walSegment
+	active     *walSegment
+	nextSeq    int64
+	nextSegID  int
+	totalBytes int64
+}
+
+func newWal(dir string, segmentSize, maxBytes int64, overflow string) (*Wal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("http: unable to create http.wal.dir: %v", err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("http: unable to read http.wal.dir: %v", err)
+	}
+
+	w := &Wal{dir: dir, segmentSize: segmentSize, maxBytes: maxBytes, overflow: overflow}
+	w.spaceCond = sync.NewCond(&w.mu)
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".wal") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".wal"))
+		if err != nil {
+			continue
+		}
+		w.segments = append(w.segments, &walSegment{
+			id:   id,
+			path: filepath.Join(dir, entry.Name()),
+			size: entry.Size(),
+		})
+		w.totalBytes += entry.Size()
+		if id >= w.nextSegID {
+			w.nextSegID = id + 1
+		}
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i].id < w.segments[j].id })
+
+	return w, nil
+}
+
+// ReadAll scans every segment on disk in order and returns the records
+// they contain. It also primes the Wal's sequence/segment bookkeeping, so
+// it must be called once, before any Append, to replay the records left
+// over from a previous run. Every record in a segment still on disk is
+// returned, whether or not it was acked before the restart.
+func (w *Wal) ReadAll() ([]walRecord, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var records []walRecord
+	for _, segment := range w.segments {
+		file, err := os.Open(segment.path)
+		if err != nil {
+			return nil, fmt.Errorf("http: unable to open WAL segment %s: %v", segment.path, err)
+		}
+		for {
+			var lenBuf [4]byte
+			if _, err := ioFullRead(file, lenBuf[:]); err != nil {
+				break
+			}
+			size := binary.BigEndian.Uint32(lenBuf[:])
+			data := make([]byte, size)
+			if _, err := ioFullRead(file, data); err != nil {
+				break
+			}
+			var rec walRecord
+			if err := json.Unmarshal(data, &rec); err != nil {
+				debug("http: skipping corrupt WAL record in", segment.path, ":", err)
+				continue
+			}
+			if !segment.hasRecords {
+				segment.firstSeq = rec.Seq
+				segment.hasRecords = true
+			}
+			segment.lastSeq = rec.Seq
+			if rec.Seq >= w.nextSeq {
+				w.nextSeq = rec.Seq + 1
+			}
+			records = append(records, rec)
+		}
+		file.Close()
+	}
+
+	if len(w.segments) > 0 {
+		last := w.segments[len(w.segments)-1]
+		file, err := os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("http: unable to reopen WAL segment %s for append: %v", last.path, err)
+		}
+		last.file = file
+		w.active = last
+	}
+	return records, nil
+}
+
+// Append durably records a message, applying backpressure once maxBytes
+// is exceeded: http.wal.overflow=block blocks until Ack frees space, while
+// drop_oldest deletes the oldest segment(s) to make room.
+func (w *Wal) Append(rec walRecord) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.maxBytes > 0 && w.totalBytes >= w.maxBytes {
+		if w.overflow == overflowDropOldest {
+			if !w.dropOldestLocked() {
+				break
+			}
+			continue
+		}
+		w.spaceCond.Wait()
+	}
+
+	rec.Seq = w.nextSeq
+	w.nextSeq++
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		debug("http: error encoding WAL record:", err)
+		return rec.Seq
+	}
+	if err := w.appendLocked(data, rec.Seq); err != nil {
+		debug("http: error writing WAL record:", err)
+	}
+	return rec.Seq
+}
+
+func (w *Wal) appendLocked(data []byte, seq int64) error {
+	entrySize := int64(len(data)) + 4
+	if w.active == nil || w.active.size+entrySize > w.segmentSize {
+		if err := w.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.active.file.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	if _, err := w.active.file.Write(data); err != nil {
+		return err
+	}
+
+	w.active.size += entrySize
+	w.totalBytes += entrySize
+	if !w.active.hasRecords {
+		w.active.firstSeq = seq
+		w.active.hasRecords = true
+	}
+	w.active.lastSeq = seq
+	return nil
+}
+
+func (w *Wal) rotateLocked() error {
+	id := w.nextSegID
+	w.nextSegID++
+	path := filepath.Join(w.dir, fmt.Sprintf("%08d.wal", id))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("http: unable to create WAL segment: %v", err)
+	}
+	segment := &walSegment{id: id, path: path, file: file}
+	w.segments = append(w.segments, segment)
+	w.active = segment
+	return nil
+}
+
+// dropOldestLocked removes the oldest segment to make room, never
+// removing the segment currently being written to. It returns false if
+// there was nothing eligible to drop.
+func (w *Wal) dropOldestLocked() bool {
+	if len(w.segments) < 2 {
+		return false
+	}
+	segment := w.segments[0]
+	if segment.file != nil {
+		segment.file.Close()
+	}
+	os.Remove(segment.path)
+	w.totalBytes -= segment.size
+	w.segments = w.segments[1:]
+	debug("http: WAL over http.wal.max_bytes, dropped oldest segment:", segment.path)
+	return true
+}
+
+// Ack deletes every rotated-away segment whose records all have a seq at
+// or below seq, and wakes any Append blocked on space. The active segment
+// is never deleted, and no committed offset is recorded.
+func (w *Wal) Ack(seq int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(w.segments) > 0 {
+		segment := w.segments[0]
+		if segment == w.active || !segment.hasRecords || segment.lastSeq > seq {
+			break
+		}
+		if segment.file != nil {
+			segment.file.Close()
+		}
+		os.Remove(segment.path)
+		w.totalBytes -= segment.size
+		w.segments = w.segments[1:]
+	}
+	w.spaceCond.Broadcast()
+}
+
+// ioFullRead reads exactly len(buf) bytes or returns an error (including
+// a clean io.EOF at a record boundary).
+func ioFullRead(file *os.File, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := file.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
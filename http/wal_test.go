@@ -0,0 +1,59 @@
+package http
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+func testMessage(data string) *router.Message {
+	return &router.Message{
+		Data:      data,
+		Container: &docker.Container{Config: &docker.Config{}},
+	}
+}
+
+// A restart that finds an on-disk segment below http.wal.segment_size must
+// still be able to append to it - ReadAll has to reopen that segment's
+// file, not just its path/size, or the following Append writes through a
+// nil *os.File and silently stops persisting anything.
+func TestWalAppendAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := newWal(dir, 16*1024*1024, 0, overflowBlock)
+	if err != nil {
+		t.Fatalf("newWal: %v", err)
+	}
+	if _, err := first.ReadAll(); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	first.Append(walRecordFor(testMessage("one")))
+
+	// Simulate a process restart: a fresh Wal over the same directory.
+	second, err := newWal(dir, 16*1024*1024, 0, overflowBlock)
+	if err != nil {
+		t.Fatalf("newWal (restart): %v", err)
+	}
+	records, err := second.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll (restart): %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 replayed record, got %d", len(records))
+	}
+
+	second.Append(walRecordFor(testMessage("two")))
+
+	third, err := newWal(dir, 16*1024*1024, 0, overflowBlock)
+	if err != nil {
+		t.Fatalf("newWal (third): %v", err)
+	}
+	records, err = third.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll (third): %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected both records to have been persisted across the restart, got %d", len(records))
+	}
+}